@@ -8,23 +8,31 @@ import (
 	"image"
 	"image/color"
 	"image/draw"
-	_ "image/jpeg"
+	"image/gif"
+	"image/jpeg"
 	"image/png"
-	"io/ioutil"
+	"io"
 	"log"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/golang/freetype"
 	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font"
 	"golang.org/x/image/font/gofont/gomono"
+	"golang.org/x/image/math/fixed"
+	_ "golang.org/x/image/webp"
 )
 
-var (
-	fg   *image.Uniform // the font color
-	bg   *image.Uniform // the background color
-	font *truetype.Font // the font to use
-)
+// fontFace is the typeface used to render text, loaded once at startup from -f or the bundled gomono default.
+// It is shared read-only across requests in -serve mode.
+var fontFace *truetype.Font
 
 var fgColor = flag.String("c", "000000ff", "Foreground color NRGBA in 8 small hex digits. Ex 0a0b0cff.")
 var bgColor = flag.String("b", "ffffe0ff", "Background color NRGBA in 8 small hex digits. Ex 0a0b0cff.")
@@ -36,6 +44,45 @@ var fontSize = flag.Float64("p", 11.0, "Font size in points.")
 var fontFile = flag.String("f", "", "A TTF file. If empty use gomono https://blog.golang.org/go-fonts.")
 var report = flag.Bool("n", false, "Don't render text but estimate and print the bounds.")
 var anchor = flag.String("a", "tl", "Where to place text on a 3x3 grid. One of tl, tc, tr, cl, c, cr, bl, bc, br. (tl -> top left etc)")
+var fit = flag.String("fit", "", "Target rectangle WxH or WxH+X+Y to fit text into. Overrides -p by picking the largest font size whose text fits W by H; X and Y are not used, the text is still placed by -a. Given with an empty value (-fit=) and -i, fits to the whole canvas image.")
+var serve = flag.String("serve", "", "Run an HTTP server on this address (ex :8080) exposing /annotate instead of processing a single image.")
+var proxy = flag.Bool("proxy", false, "With -serve, also expose /proxy?url=... which fetches an image and stamps it on the fly, like a transparent annotating proxy.")
+
+var outFormat = flag.String("of", "", "Output format: png, jpeg or gif. If empty, it's derived from the -o extension (png when writing to stdout with -o -).")
+var jpegQuality = flag.Int("q", 90, "JPEG quality (1-100), used when the output format is jpeg.")
+
+var spacing = flag.Float64("spacing", 1.2, "Line spacing as a multiplier of the font size.")
+var hinting = flag.String("hinting", "none", "Font hinting: none, vertical or full.")
+var align = flag.String("align", "left", "Horizontal alignment of shorter lines within the rendered text block: left, center or right.")
+
+var wrapWidth = flag.Int("w", 0, "Wrap input lines to this maximum pixel width before rendering. 0 disables wrapping. Cannot be combined with -fit.")
+var breakLongWords = flag.Bool("break-long-words", false, "With -w, break tokens longer than the wrap width instead of letting them overflow.")
+
+var shadow = flag.Bool("shadow", false, "Draw each line with a drop shadow before the foreground text.")
+var shadowColor = flag.String("shadow-color", "000000ff", "Shadow color NRGBA in 8 small hex digits.")
+var shadowDX = flag.Int("shadow-dx", 2, "Shadow horizontal offset in pixels.")
+var shadowDY = flag.Int("shadow-dy", 2, "Shadow vertical offset in pixels.")
+var outline = flag.Bool("outline", false, "Draw each line with a stroked outline before the foreground text.")
+var outlineColor = flag.String("outline-color", "000000ff", "Outline color NRGBA in 8 small hex digits.")
+var outlineWidth = flag.Int("outline-width", 1, "Outline stroke width in pixels.")
+
+// outlineOffsets are the 8 unit directions (N, NE, E, SE, S, SW, W, NW) the outline is stamped at, scaled
+// by each radius from 1 to the outline width so the stroke is a solid band rather than a hollow ring.
+var outlineOffsets = [8]image.Point{
+	{X: 0, Y: -1}, {X: 1, Y: -1}, {X: 1, Y: 0}, {X: 1, Y: 1},
+	{X: 0, Y: 1}, {X: -1, Y: 1}, {X: -1, Y: 0}, {X: -1, Y: -1},
+}
+
+// style controls the decorations applied to text in render, on top of the plain foreground pass
+type style struct {
+	shadow       bool
+	shadowSrc    *image.Uniform
+	shadowDX     int
+	shadowDY     int
+	outline      bool
+	outlineSrc   *image.Uniform
+	outlineWidth int
+}
 
 // allocColorImage parses col which is an NRGBA color (ex 0a0b0cff) and return a uniform image of that color
 func allocColorImage(col string) *image.Uniform {
@@ -50,45 +97,261 @@ func allocColorImage(col string) *image.Uniform {
 	})
 }
 
-// bounds estimates an upper bound for the area needed to render lines
-// The ctx must be configured with fontsize and DPI
-func bounds(ctx *freetype.Context, lines []string) image.Rectangle {
-	maxLen := 0
+// lineWidth measures the true advance width of line at the given truetype scale, including kerning
+func lineWidth(f *truetype.Font, scale fixed.Int26_6, line string) fixed.Int26_6 {
+	var width fixed.Int26_6
+	var prev truetype.Index
+	hasPrev := false
+	for _, r := range line {
+		idx := f.Index(r)
+		if hasPrev {
+			width += f.Kern(scale, prev, idx)
+		}
+		width += f.HMetric(scale, idx).AdvanceWidth
+		prev, hasPrev = idx, true
+	}
+	return width
+}
+
+// fontScale returns the truetype scale for fontSize at dpi, the same value ctx.PointToFixed(fontSize) would
+// give once ctx has been configured with SetDPI(dpi)
+func fontScale(fontSize, dpi float64) fixed.Int26_6 {
+	return fixed.Int26_6(fontSize * dpi * (64.0 / 72.0))
+}
+
+// breakWord splits w into chunks that each fit within maxWidth at scale, breaking at rune boundaries
+func breakWord(w string, scale, maxWidth fixed.Int26_6) []string {
+	var out []string
+	var cur []rune
+	curWidth := fixed.Int26_6(0)
+	for _, r := range w {
+		rw := lineWidth(fontFace, scale, string(r))
+		if len(cur) > 0 && curWidth+rw > maxWidth {
+			out = append(out, string(cur))
+			cur = nil
+			curWidth = 0
+		}
+		cur = append(cur, r)
+		curWidth += rw
+	}
+	if len(cur) > 0 {
+		out = append(out, string(cur))
+	}
+	return out
+}
+
+// wrapLine word-wraps line to maxWidth at scale, greedily packing words onto each output line and splitting
+// at the last whitespace before the width would be exceeded. With breakLongWords, a single token wider than
+// maxWidth is itself broken into pieces; otherwise it is left to overflow on its own line.
+func wrapLine(line string, scale, maxWidth fixed.Int26_6, breakLongWords bool) []string {
+	words := strings.Fields(line)
+	if len(words) == 0 {
+		return []string{line}
+	}
+
+	spaceWidth := lineWidth(fontFace, scale, " ")
+	var out []string
+	var cur []string
+	curWidth := fixed.Int26_6(0)
+
+	flush := func() {
+		if len(cur) > 0 {
+			out = append(out, strings.Join(cur, " "))
+			cur = nil
+			curWidth = 0
+		}
+	}
+
+	for _, w := range words {
+		ww := lineWidth(fontFace, scale, w)
+		if breakLongWords && ww > maxWidth {
+			flush()
+			out = append(out, breakWord(w, scale, maxWidth)...)
+			continue
+		}
+
+		newWidth := ww
+		if len(cur) > 0 {
+			newWidth = curWidth + spaceWidth + ww
+		}
+		if len(cur) > 0 && newWidth > maxWidth {
+			flush()
+			cur = append(cur, w)
+			curWidth = ww
+		} else {
+			cur = append(cur, w)
+			curWidth = newWidth
+		}
+	}
+	flush()
+
+	return out
+}
+
+// wrapLines word-wraps every line in lines to maxWidthPx pixels, measured at fontSize/dpi. maxWidthPx <= 0
+// disables wrapping.
+func wrapLines(lines []string, fontSize, dpi float64, maxWidthPx int, breakLongWords bool) []string {
+	if maxWidthPx <= 0 {
+		return lines
+	}
+
+	scale := fontScale(fontSize, dpi)
+	maxWidth := fixed.I(maxWidthPx)
+
+	var out []string
+	for _, line := range lines {
+		out = append(out, wrapLine(line, scale, maxWidth, breakLongWords)...)
+	}
+	return out
+}
+
+// maxLineWidth returns the widest line at the given truetype scale
+func maxLineWidth(scale fixed.Int26_6, lines []string) fixed.Int26_6 {
+	maxWidth := fixed.Int26_6(0)
 	for _, line := range lines {
-		if l := len(line); l > maxLen {
-			maxLen = l
+		if w := lineWidth(fontFace, scale, line); w > maxWidth {
+			maxWidth = w
 		}
 	}
+	return maxWidth
+}
+
+// alignOffset returns how far a line of width lw should be shifted right so it sits left, centered or right
+// aligned within a block of width blockWidth
+func alignOffset(align string, blockWidth, lw fixed.Int26_6) fixed.Int26_6 {
+	switch align {
+	case "center":
+		return (blockWidth - lw) / 2
+	case "right":
+		return blockWidth - lw
+	default:
+		return 0
+	}
+}
 
-	po := ctx.PointToFixed(*fontSize)       // 1em for all margins top, bottom, left, right
-	vs := ctx.PointToFixed(*fontSize + 2.0) // vertical spacing between lines need 2 more points
+// validAlign reports whether align is one of the supported -align values
+func validAlign(align string) bool {
+	switch align {
+	case "left", "center", "right":
+		return true
+	}
+	return false
+}
 
-	dx := maxLen*po.Ceil() + 4*po.Ceil()     // +4 for left, right margins and a safety margin
+// parseHinting maps a -hinting flag value to the font.Hinting freetype expects
+func parseHinting(s string) (font.Hinting, error) {
+	switch s {
+	case "", "none":
+		return font.HintingNone, nil
+	case "vertical":
+		return font.HintingVertical, nil
+	case "full":
+		return font.HintingFull, nil
+	default:
+		return font.HintingNone, fmt.Errorf("invalid hinting %q, want none, vertical or full", s)
+	}
+}
+
+// bounds estimates an upper bound for the area needed to render lines at fontSize, with the given line spacing
+// (a multiplier of fontSize). The ctx must be configured with DPI
+func bounds(ctx *freetype.Context, fontSize, spacing float64, lines []string) image.Rectangle {
+	po := ctx.PointToFixed(fontSize)           // 1em for all margins top, bottom, left, right; also the truetype scale
+	vs := ctx.PointToFixed(fontSize * spacing) // vertical spacing between lines
+
+	maxWidth := maxLineWidth(po, lines)
+
+	dx := maxWidth.Ceil() + 4*po.Ceil()      // +4 for left, right margins and a safety margin
 	dy := len(lines)*vs.Ceil() + 4*po.Ceil() // +4 po for top, bottom margins and a safety margin
 
 	return image.Rect(0, 0, dx, dy)
 }
 
+// parseFit parses a -fit geometry of the form WxH or WxH+X+Y and returns the corresponding rectangle
+func parseFit(s string) (image.Rectangle, error) {
+	var w, h, x, y int
+	if n, _ := fmt.Sscanf(s, "%dx%d+%d+%d", &w, &h, &x, &y); n == 4 {
+		return image.Rect(x, y, x+w, y+h), nil
+	}
+	if n, _ := fmt.Sscanf(s, "%dx%d", &w, &h); n == 2 {
+		return image.Rect(0, 0, w, h), nil
+	}
+	return image.Rectangle{}, fmt.Errorf("invalid -fit geometry %q, want WxH or WxH+X+Y", s)
+}
+
+// fitFontSize binary-searches the largest point size such that lines, rendered at that size, fit inside target
+func fitFontSize(lines []string, dpi, spacing float64, target image.Rectangle) float64 {
+	ctx := freetype.NewContext()
+	ctx.SetFont(fontFace)
+	ctx.SetDPI(dpi)
+
+	fits := func(size float64) bool {
+		b := bounds(ctx, size, spacing, lines)
+		return b.Dx() <= target.Dx() && b.Dy() <= target.Dy()
+	}
+
+	lo, hi := 1.0, 500.0
+	for hi-lo > 0.25 {
+		mid := (lo + hi) / 2
+		if fits(mid) {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return lo
+}
+
+// drawLineAt draws line at p using src as the paint source and returns the advance past the last glyph
+func drawLineAt(ctx *freetype.Context, src *image.Uniform, line string, p fixed.Point26_6) (fixed.Point26_6, error) {
+	ctx.SetSrc(src)
+	return ctx.DrawString(line, p)
+}
+
 // render creates a new image with a transparent background, renders the lines and returns it
-func render(lines []string) (image.Image, error) {
+func render(lines []string, fontSize, dpi, spacing float64, hint font.Hinting, align string, fg *image.Uniform, st style) (image.Image, error) {
 	ctx := freetype.NewContext()
-	ctx.SetFont(font)
-	ctx.SetFontSize(*fontSize)
+	ctx.SetFont(fontFace)
+	ctx.SetFontSize(fontSize)
 	ctx.SetSrc(fg)
-	ctx.SetDPI(*dpi)
+	ctx.SetDPI(dpi)
+	ctx.SetHinting(hint)
 
 	// bounds needs to be called after SetDPI, SetFont, SetFontSize
-	img := image.NewRGBA(bounds(ctx, lines))
+	img := image.NewRGBA(bounds(ctx, fontSize, spacing, lines))
 	ctx.SetClip(img.Bounds())
 	ctx.SetDst(img)
 
-	vs := ctx.PointToFixed(*fontSize + 2.0) // vertical spacing between lines need 2 more points
-	offset := freetype.Pt(16, 16)           // 16 pixels fixed size margins
-	bounds := freetype.Pt(0, 0)             // actual bounds of image, updated after each draw operation
+	po := ctx.PointToFixed(fontSize)           // truetype scale, used to measure each line for alignment
+	vs := ctx.PointToFixed(fontSize * spacing) // vertical spacing between lines
+	maxWidth := maxLineWidth(po, lines)        // width of the rendered text block, for -align
+
+	offset := freetype.Pt(16, 16) // 16 pixels fixed size margins
+	bounds := freetype.Pt(0, 0)   // actual bounds of image, updated after each draw operation
 	p := offset
 	for _, line := range lines {
 		p.Y += vs
-		if p1, err := ctx.DrawString(line, p); err != nil {
+		p.X = offset.X + alignOffset(align, maxWidth, lineWidth(fontFace, po, line))
+
+		if st.outline {
+			for radius := 1; radius <= st.outlineWidth; radius++ {
+				for _, d := range outlineOffsets {
+					off := freetype.Pt(d.X*radius, d.Y*radius)
+					op := fixed.Point26_6{X: p.X + off.X, Y: p.Y + off.Y}
+					if _, err := drawLineAt(ctx, st.outlineSrc, line, op); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+		if st.shadow {
+			off := freetype.Pt(st.shadowDX, st.shadowDY)
+			sp := fixed.Point26_6{X: p.X + off.X, Y: p.Y + off.Y}
+			if _, err := drawLineAt(ctx, st.shadowSrc, line, sp); err != nil {
+				return nil, err
+			}
+		}
+
+		if p1, err := drawLineAt(ctx, fg, line, p); err != nil {
 			return nil, err
 		} else if p1.X > bounds.X {
 			bounds.X = p1.X
@@ -101,26 +364,52 @@ func render(lines []string) (image.Image, error) {
 	return img.SubImage(image.Rect(0, 0, bounds.X.Ceil(), bounds.Y.Ceil())), nil
 }
 
-// writeImage write the PNG encoding of img to the new file fname
-func writeImage(img image.Image, fname string) error {
-	var buf bytes.Buffer
-	if err := png.Encode(&buf, img); err != nil {
-		return err
+// formatFromExt maps an output file extension to an encodeImage format
+func formatFromExt(name string) (string, error) {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".png":
+		return "png", nil
+	case ".jpg", ".jpeg":
+		return "jpeg", nil
+	case ".gif":
+		return "gif", nil
+	default:
+		return "", fmt.Errorf("unrecognized output extension %q", filepath.Ext(name))
+	}
+}
+
+// contentTypeFor returns the HTTP Content-Type for an encodeImage format
+func contentTypeFor(format string) string {
+	switch format {
+	case "jpeg":
+		return "image/jpeg"
+	case "gif":
+		return "image/gif"
+	default:
+		return "image/png"
 	}
+}
 
-	return ioutil.WriteFile(fname, buf.Bytes(), 0644)
+// encodeImage encodes img as format ("png", "jpeg" or "gif") and streams it to w. quality is only used
+// for jpeg.
+func encodeImage(w io.Writer, img image.Image, format string, quality int) error {
+	switch format {
+	case "png":
+		return png.Encode(w, img)
+	case "jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	case "gif":
+		return gif.Encode(w, img, nil)
+	default:
+		return fmt.Errorf("unsupported output format %q", format)
+	}
 }
 
-// textToRender reads standard input or the -t flag, optionally replaces tabs with spaces and returns the lines
-func textToRender() ([]string, error) {
+// splitLines reads r, replaces tabs with spaces and returns the lines
+func splitLines(r io.Reader) ([]string, error) {
 	lines := make([]string, 0)
 
-	var scanner *bufio.Scanner
-	if *text == "" {
-		scanner = bufio.NewScanner(os.Stdin)
-	} else {
-		scanner = bufio.NewScanner(bytes.NewBufferString(*text))
-	}
+	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
 		lines = append(lines, strings.ReplaceAll(scanner.Text(), "\t", "    "))
 	}
@@ -128,10 +417,18 @@ func textToRender() ([]string, error) {
 	return lines, scanner.Err()
 }
 
+// textToRender reads standard input or the -t flag, replaces tabs with spaces and returns the lines
+func textToRender() ([]string, error) {
+	if *text == "" {
+		return splitLines(os.Stdin)
+	}
+	return splitLines(bytes.NewBufferString(*text))
+}
+
 // canvas returns the image to write on. It is either a uniform background color or an image read from a file.
 // If fname is not empty it reads the image file and returns it. Otherwise it allocates an image of size bounds,
-// uniformly colored with the background color
-func canvas(fname string, bounds image.Rectangle) (draw.Image, error) {
+// uniformly colored with bg
+func canvas(fname string, bg *image.Uniform, bounds image.Rectangle) (draw.Image, error) {
 	if fname == "" {
 		dst := image.NewRGBA(bounds)
 		draw.Draw(dst, dst.Bounds(), bg, image.Pt(0, 0), draw.Src)
@@ -146,10 +443,22 @@ func canvas(fname string, bounds image.Rectangle) (draw.Image, error) {
 
 	img, _, err := image.Decode(fin)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	return img.(draw.Image), nil
+	return promoteToDrawImage(img), nil
+}
+
+// promoteToDrawImage returns img as a draw.Image, copying it onto a fresh RGBA canvas first if its concrete
+// type doesn't already support drawing on (e.g. a decoded JPEG, which image.Decode returns as *image.YCbCr)
+func promoteToDrawImage(img image.Image) draw.Image {
+	if di, ok := img.(draw.Image); ok {
+		return di
+	}
+
+	dst := image.NewRGBA(img.Bounds())
+	draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Src)
+	return dst
 }
 
 // textRect returns the rectangle of dst where src should be placed according to pos
@@ -186,6 +495,351 @@ func textRect(dst, src image.Image, pos string) image.Rectangle {
 	return image.Rect(ap.X, ap.Y, ap.X+src.Bounds().Dx(), ap.Y+src.Bounds().Dy())
 }
 
+// Params bundles everything render, canvas and textRect need for one annotation, so they can be driven
+// either by the command line flags (one-shot CLI invocation) or by an HTTP request (-serve mode).
+type Params struct {
+	Lines    []string
+	FG       string // foreground color, NRGBA hex
+	BG       string // background color, NRGBA hex
+	FontSize float64
+	DPI      float64
+	Anchor   string
+	Fit      string // -fit geometry, overrides FontSize; see parseFit
+	FitSet   bool   // true when -fit was explicitly given, even as an empty value meaning "fit the whole canvas"
+	Spacing  float64
+	Hinting  string // none, vertical or full; see parseHinting
+	Align    string // left, center or right
+	Style    style
+
+	MaxWidth       int  // -w: wrap lines to this pixel width before rendering; 0 disables wrapping
+	BreakLongWords bool // -break-long-words: break tokens wider than MaxWidth instead of letting them overflow
+
+	CanvasImage image.Image // decoded canvas, takes priority over CanvasPath; used by -serve
+	CanvasPath  string      // path to a canvas image file; used by the CLI's -i
+}
+
+// fitTargetFor resolves the rectangle that p.Fit should shrink text into: the explicit geometry if given,
+// otherwise the bounds of the canvas image, if any. ok is false when -fit was not given, or there is
+// nothing to fit to.
+func fitTargetFor(p Params) (r image.Rectangle, ok bool, err error) {
+	if !p.FitSet {
+		return image.Rectangle{}, false, nil
+	}
+	if p.Fit != "" {
+		r, err = parseFit(p.Fit)
+		return r, err == nil, err
+	}
+	if p.CanvasImage != nil {
+		return p.CanvasImage.Bounds(), true, nil
+	}
+	if p.CanvasPath == "" {
+		return image.Rectangle{}, false, nil
+	}
+
+	fin, err := os.Open(p.CanvasPath)
+	if err != nil {
+		return image.Rectangle{}, false, err
+	}
+	defer fin.Close()
+
+	cfg, _, err := image.DecodeConfig(fin)
+	if err != nil {
+		return image.Rectangle{}, false, err
+	}
+	return image.Rect(0, 0, cfg.Width, cfg.Height), true, nil
+}
+
+// canvasFor resolves the canvas to draw on for p: an already decoded image takes priority, then a file path,
+// otherwise a plain bg-filled canvas of the given bounds.
+func canvasFor(p Params, bg *image.Uniform, bounds image.Rectangle) (draw.Image, error) {
+	if p.CanvasImage != nil {
+		return promoteToDrawImage(p.CanvasImage), nil
+	}
+	return canvas(p.CanvasPath, bg, bounds)
+}
+
+// renderText renders just the text layer for p, resolving -fit to a concrete font size first, and returns
+// the transparent text image together with the font size actually used. -w and -fit cannot be combined:
+// -w wraps lines to a pixel width measured at p.FontSize, which would be stale once -fit picks a
+// different size.
+func renderText(p Params) (image.Image, float64, error) {
+	hint, err := parseHinting(p.Hinting)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !validAlign(p.Align) {
+		return nil, 0, fmt.Errorf("invalid align %q, want left, center or right", p.Align)
+	}
+
+	target, hasFit, err := fitTargetFor(p)
+	if err != nil {
+		return nil, 0, err
+	}
+	if hasFit && p.MaxWidth > 0 {
+		return nil, 0, fmt.Errorf("-w cannot be combined with -fit: -w wraps lines before the fitted font size is known")
+	}
+
+	lines := wrapLines(p.Lines, p.FontSize, p.DPI, p.MaxWidth, p.BreakLongWords)
+
+	fontSize := p.FontSize
+	if hasFit {
+		fontSize = fitFontSize(lines, p.DPI, p.Spacing, target)
+	}
+
+	fg := allocColorImage(p.FG)
+	img, err := render(lines, fontSize, p.DPI, p.Spacing, hint, p.Align, fg, p.Style)
+	return img, fontSize, err
+}
+
+// Render renders p's text and composites it onto p's canvas, returning the final image ready to be written out
+func Render(p Params) (image.Image, error) {
+	img, _, err := renderText(p)
+	if err != nil {
+		return nil, err
+	}
+
+	bg := allocColorImage(p.BG)
+	cimg, err := canvasFor(p, bg, img.Bounds())
+	if err != nil {
+		return nil, err
+	}
+
+	draw.Draw(cimg, textRect(cimg, img, p.Anchor), img, image.Pt(0, 0), draw.Over)
+	return cimg, nil
+}
+
+// validAnchor reports whether pos is one of the 9 grid positions textRect understands
+func validAnchor(pos string) bool {
+	switch pos {
+	case "tl", "tc", "tr", "cl", "c", "cr", "bl", "bc", "br":
+		return true
+	}
+	return false
+}
+
+// styleFromQuery builds a style from HTTP query parameters, reusing the same shadow/outline conventions as
+// the CLI flags (-shadow, -shadow-color, ... -outline, -outline-color, -outline-width)
+func styleFromQuery(q url.Values) style {
+	st := style{
+		shadow:       q.Get("shadow") != "",
+		shadowDX:     queryInt(q, "shadow-dx", 2),
+		shadowDY:     queryInt(q, "shadow-dy", 2),
+		outline:      q.Get("outline") != "",
+		outlineWidth: queryInt(q, "outline-width", 1),
+	}
+	if st.shadow {
+		st.shadowSrc = allocColorImage(queryString(q, "shadow-color", "000000ff"))
+	}
+	if st.outline {
+		st.outlineSrc = allocColorImage(queryString(q, "outline-color", "000000ff"))
+	}
+	return st
+}
+
+func queryString(q url.Values, key, def string) string {
+	if v := q.Get(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func queryInt(q url.Values, key string, def int) int {
+	if v := q.Get(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+	}
+	return def
+}
+
+func queryFloat(q url.Values, key string, def float64) float64 {
+	if v := q.Get(key); v != "" {
+		if n, err := strconv.ParseFloat(v, 64); err == nil {
+			return n
+		}
+	}
+	return def
+}
+
+// paramsFromRequest builds Params from an /annotate request's query parameters (t, a, c, b, p, d, fit,
+// spacing, hinting, align, w, break-long-words and the shadow/outline ones read by styleFromQuery) and its
+// uploaded or fetched canvas image. The server's own font, loaded at
+// startup from -f, is always used; an HTTP client cannot make carver read an arbitrary server-side font file.
+func paramsFromRequest(r *http.Request, canvasImg image.Image) (Params, error) {
+	q := r.URL.Query()
+
+	lines, err := splitLines(strings.NewReader(q.Get("t")))
+	if err != nil {
+		return Params{}, err
+	}
+
+	anchor := queryString(q, "a", "tl")
+	if !validAnchor(anchor) {
+		return Params{}, fmt.Errorf("invalid anchor %q", anchor)
+	}
+
+	return Params{
+		Lines:          lines,
+		FG:             queryString(q, "c", "000000ff"),
+		BG:             queryString(q, "b", "ffffe0ff"),
+		FontSize:       queryFloat(q, "p", 11.0),
+		DPI:            queryFloat(q, "d", 96.0),
+		Anchor:         anchor,
+		Fit:            q.Get("fit"),
+		FitSet:         q.Has("fit"),
+		Spacing:        queryFloat(q, "spacing", 1.2),
+		Hinting:        queryString(q, "hinting", "none"),
+		Align:          queryString(q, "align", "left"),
+		Style:          styleFromQuery(q),
+		MaxWidth:       queryInt(q, "w", 0),
+		BreakLongWords: q.Get("break-long-words") != "",
+		CanvasImage:    canvasImg,
+	}, nil
+}
+
+// fetchImageURL guards against SSRF when -serve fetches a client-supplied URL (the "url" query parameter
+// on /annotate and /proxy): it only allows http/https and rejects hosts that resolve to loopback,
+// link-local, unspecified or private addresses, so a request can't be used to probe the server's own
+// network (e.g. a cloud metadata endpoint). Every connection made for the fetch, including those that
+// follow a redirect, is checked again against the address actually dialed.
+func fetchImageURL(rawurl string) (*http.Response, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported url scheme %q, want http or https", u.Scheme)
+	}
+
+	ips, err := net.LookupIP(u.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() || ip.IsPrivate() {
+			return nil, fmt.Errorf("url host %q resolves to a disallowed address %s", u.Hostname(), ip)
+		}
+	}
+
+	dialer := &net.Dialer{Control: func(network, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() || ip.IsPrivate() {
+			return fmt.Errorf("refusing to connect to disallowed address %s", host)
+		}
+		return nil
+	}}
+	client := &http.Client{Transport: &http.Transport{DialContext: dialer.DialContext}}
+	return client.Get(rawurl)
+}
+
+// canvasFromRequest decodes the canvas image for an /annotate request: an uploaded multipart file under the
+// "image" field takes priority, otherwise the "url" query parameter is fetched over HTTP.
+func canvasFromRequest(r *http.Request) (image.Image, error) {
+	if f, _, err := r.FormFile("image"); err == nil {
+		defer f.Close()
+		img, _, err := image.Decode(f)
+		return img, err
+	} else if err != http.ErrNotMultipart && err != http.ErrMissingFile {
+		return nil, err
+	}
+
+	if u := r.URL.Query().Get("url"); u != "" {
+		resp, err := fetchImageURL(u)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		img, _, err := image.Decode(resp.Body)
+		return img, err
+	}
+
+	return nil, nil
+}
+
+// annotateHandler serves /annotate: it decodes the uploaded or fetched image, renders the requested text
+// over it and writes back the encoded image in the format requested via ?format= (default png).
+func annotateHandler(w http.ResponseWriter, r *http.Request) {
+	canvasImg, err := canvasFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p, err := paramsFromRequest(r, canvasImg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	img, err := Render(p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	format := queryString(r.URL.Query(), "format", "png")
+	w.Header().Set("Content-Type", contentTypeFor(format))
+	if err := encodeImage(w, img, format, queryInt(r.URL.Query(), "q", 90)); err != nil {
+		log.Println(err)
+	}
+}
+
+// proxyHandler serves /proxy: like /annotate with its image taken from ?url=, so carver can sit in front
+// of another image server and transparently stamp every image it serves, similar to a goproxy annotator.
+func proxyHandler(w http.ResponseWriter, r *http.Request) {
+	u := r.URL.Query().Get("url")
+	if u == "" {
+		http.Error(w, "missing url parameter", http.StatusBadRequest)
+		return
+	}
+
+	resp, err := fetchImageURL(u)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	canvasImg, _, err := image.Decode(resp.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	p, err := paramsFromRequest(r, canvasImg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	img, err := Render(p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	format := queryString(r.URL.Query(), "format", "png")
+	w.Header().Set("Content-Type", contentTypeFor(format))
+	if err := encodeImage(w, img, format, queryInt(r.URL.Query(), "q", 90)); err != nil {
+		log.Println(err)
+	}
+}
+
+// serveHTTP runs the -serve HTTP server, exposing /annotate and, with -proxy, /proxy
+func serveHTTP(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/annotate", annotateHandler)
+	if *proxy {
+		mux.HandleFunc("/proxy", proxyHandler)
+	}
+
+	log.Printf("carver: listening on %s", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
 func usage() {
 	fmt.Fprintf(os.Stderr, `usage: carver -t <text> -i image.png -o out.png
 
@@ -201,7 +855,14 @@ func main() {
 	flag.Usage = usage
 	flag.Parse()
 
-	if *outFile == "" && !*report {
+	fitSet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "fit" {
+			fitSet = true
+		}
+	})
+
+	if *serve == "" && *outFile == "" && !*report {
 		usage()
 	}
 
@@ -220,34 +881,88 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	font = f
+	fontFace = f
 
-	fg = allocColorImage(*fgColor)
-	bg = allocColorImage(*bgColor)
+	if *serve != "" {
+		if err := serveHTTP(*serve); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	st := style{
+		shadow:       *shadow,
+		shadowDX:     *shadowDX,
+		shadowDY:     *shadowDY,
+		outline:      *outline,
+		outlineWidth: *outlineWidth,
+	}
+	if st.shadow {
+		st.shadowSrc = allocColorImage(*shadowColor)
+	}
+	if st.outline {
+		st.outlineSrc = allocColorImage(*outlineColor)
+	}
 
 	lines, err := textToRender()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	img, err := render(lines)
-	if err != nil {
-		log.Fatal(err)
+	p := Params{
+		Lines:          lines,
+		FG:             *fgColor,
+		BG:             *bgColor,
+		FontSize:       *fontSize,
+		DPI:            *dpi,
+		Anchor:         *anchor,
+		Fit:            *fit,
+		FitSet:         fitSet,
+		Spacing:        *spacing,
+		Hinting:        *hinting,
+		Align:          *align,
+		Style:          st,
+		MaxWidth:       *wrapWidth,
+		BreakLongWords: *breakLongWords,
+		CanvasPath:     *inFile,
 	}
 
 	if *report {
-		fmt.Printf("%dx%d", img.Bounds().Dx(), img.Bounds().Dy())
-	} else {
-		cimg, err := canvas(*inFile, img.Bounds())
+		img, _, err := renderText(p)
 		if err != nil {
 			log.Fatal(err)
 		}
+		fmt.Printf("%dx%d", img.Bounds().Dx(), img.Bounds().Dy())
+		return
+	}
 
-		draw.Draw(cimg, textRect(cimg, img, *anchor), img, image.Pt(0, 0), draw.Over)
+	img, err := Render(p)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		err = writeImage(cimg, *outFile)
+	format := *outFormat
+	if format == "" {
+		if *outFile == "-" {
+			format = "png"
+		} else if format, err = formatFromExt(*outFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var out io.Writer
+	if *outFile == "-" {
+		out = os.Stdout
+	} else {
+		f, err := os.Create(*outFile)
 		if err != nil {
 			log.Fatal(err)
 		}
+		defer f.Close()
+		out = f
+	}
+
+	if err := encodeImage(out, img, format, *jpegQuality); err != nil {
+		log.Fatal(err)
 	}
 }